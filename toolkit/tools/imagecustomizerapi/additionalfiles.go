@@ -0,0 +1,23 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+import "io/fs"
+
+// Permissions is the file mode to apply to a copied file.
+type Permissions fs.FileMode
+
+// FileConfig describes a single source-to-destination file copy. When the source is a glob
+// pattern, Path is treated as a destination directory rather than a destination file.
+type FileConfig struct {
+	Path         string       `yaml:"Path"`
+	Permissions  *Permissions `yaml:"Permissions"`
+	Owner        string       `yaml:"Owner"`
+	Group        string       `yaml:"Group"`
+	SELinuxLabel string       `yaml:"SELinuxLabel"`
+	Recursive    bool         `yaml:"Recursive"`
+}
+
+// FileConfigList is the set of destinations that a single source file should be copied to.
+type FileConfigList []FileConfig
@@ -0,0 +1,9 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// Config is the top-level configuration for the image customizer tool.
+type Config struct {
+	SystemConfig SystemConfig `yaml:"SystemConfig"`
+}
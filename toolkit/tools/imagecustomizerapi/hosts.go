@@ -0,0 +1,11 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// HostsEntry describes a single name resolution entry to add to /etc/hosts.
+type HostsEntry struct {
+	IP        string   `yaml:"IP"`
+	Hostnames []string `yaml:"Hostnames"`
+	Comment   string   `yaml:"Comment"`
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// Softdep describes soft module dependencies, written as a modprobe.d "softdep" line.
+type Softdep struct {
+	Pre  []string `yaml:"Pre"`
+	Post []string `yaml:"Post"`
+}
+
+// Module describes a single kernel module to load or blacklist inside the chroot.
+type Module struct {
+	Name    string            `yaml:"Name"`
+	Options map[string]string `yaml:"Options"`
+
+	// Order controls the boot-time load order relative to other modules. When set, the
+	// modules-load.d file is named "NN-<mod>.conf" instead of "<mod>.conf".
+	Order int `yaml:"Order"`
+
+	Softdep Softdep `yaml:"Softdep"`
+
+	// Install and Remove override modprobe's default install/remove behavior for this module.
+	Install string `yaml:"Install"`
+	Remove  string `yaml:"Remove"`
+}
+
+// Modules is the set of kernel modules to load or disable inside the chroot.
+type Modules struct {
+	Load    []Module `yaml:"Load"`
+	Disable []Module `yaml:"Disable"`
+}
@@ -0,0 +1,37 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// Repository describes a single .repo file to add, or an existing repo to toggle, before package
+// installation. Either Content or Path may be set to add a new repo; ID alone (with Enabled) can
+// be used to toggle an already-shipped repo on or off.
+type Repository struct {
+	ID      string `yaml:"ID"`
+	Content string `yaml:"Content"`
+	Path    string `yaml:"Path"`
+
+	// Enabled toggles the repo (new or existing) on or off via dnf config-manager.
+	Enabled *bool `yaml:"Enabled"`
+
+	// BuildTimeOnly removes this repo file once package installation has finished. It requires
+	// Content or Path to be set; it cannot be used to temporarily toggle an existing shipped
+	// repo's Enabled state, since there would be no reliable prior state to restore.
+	BuildTimeOnly bool `yaml:"BuildTimeOnly"`
+}
+
+// GPGKey describes a GPG key to import into the RPM database before package installation.
+type GPGKey struct {
+	// Path is a config-relative path to the key file under baseConfigPath.
+	Path string `yaml:"Path"`
+
+	// BuildTimeOnly untrusts this key (via "rpm -e" on its gpg-pubkey package) once package
+	// installation has finished, unless the key was already trusted beforehand.
+	BuildTimeOnly bool `yaml:"BuildTimeOnly"`
+}
+
+// Repositories is the set of repository customizations to apply before package installation.
+type Repositories struct {
+	Repos   []Repository `yaml:"Repos"`
+	GPGKeys []GPGKey     `yaml:"GPGKeys"`
+}
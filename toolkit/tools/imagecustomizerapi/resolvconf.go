@@ -0,0 +1,29 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+const (
+	// ResolvConfModeHost copies the build host's resolv.conf into the image (the historical, default behavior).
+	ResolvConfModeHost = "host"
+
+	// ResolvConfModeGenerate writes a resolv.conf generated from Nameservers/Searches/Options.
+	ResolvConfModeGenerate = "generate"
+
+	// ResolvConfModePreserve leaves the base image's existing resolv.conf (or symlink) untouched.
+	ResolvConfModePreserve = "preserve"
+
+	// ResolvConfModeSymlinkToPrefix, followed by a target path, points resolv.conf at an
+	// alternate location (e.g. "symlink-to ../run/systemd/resolve/stub-resolv.conf").
+	ResolvConfModeSymlinkToPrefix = "symlink-to"
+)
+
+// ResolvConf describes how /etc/resolv.conf should be managed during customization.
+type ResolvConf struct {
+	// Mode is one of "host", "generate", "preserve", or "symlink-to <target>". Defaults to "host".
+	Mode string `yaml:"Mode"`
+
+	Nameservers []string `yaml:"Nameservers"`
+	Searches    []string `yaml:"Searches"`
+	Options     []string `yaml:"Options"`
+}
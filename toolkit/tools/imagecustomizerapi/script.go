@@ -0,0 +1,24 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// Script describes a single script to execute inside the chroot.
+//
+// Either Path (relative to the config directory) or Content (inline script source) must be set.
+type Script struct {
+	Path    string `yaml:"Path"`
+	Args    string `yaml:"Args"`
+	Content string `yaml:"Content"`
+
+	// Interpreter is the program used to run the script. Defaults to "/bin/sh".
+	Interpreter string `yaml:"Interpreter"`
+
+	Env            map[string]string `yaml:"Env"`
+	WorkingDir     string            `yaml:"WorkingDir"`
+	TimeoutSeconds int               `yaml:"TimeoutSeconds"`
+
+	// ContinueOnError causes customization to proceed to the next script (and phase) even if
+	// this script exits with a non-zero status.
+	ContinueOnError bool `yaml:"ContinueOnError"`
+}
@@ -0,0 +1,15 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// Service identifies a systemd unit by name.
+type Service struct {
+	Name string `yaml:"Name"`
+}
+
+// Services is the set of systemd units to enable or disable inside the chroot.
+type Services struct {
+	Enable  []Service `yaml:"Enable"`
+	Disable []Service `yaml:"Disable"`
+}
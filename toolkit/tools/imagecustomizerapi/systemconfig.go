@@ -0,0 +1,19 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// SystemConfig describes the set of OS-level customizations to apply inside the chroot.
+type SystemConfig struct {
+	Hostname             string                    `yaml:"Hostname"`
+	HostsEntries         []HostsEntry              `yaml:"HostsEntries"`
+	ResolvConf           ResolvConf                `yaml:"ResolvConf"`
+	Repositories         Repositories              `yaml:"Repositories"`
+	AdditionalFiles      map[string]FileConfigList `yaml:"AdditionalFiles"`
+	Users                []User                    `yaml:"Users"`
+	Services             Services                  `yaml:"Services"`
+	Modules              Modules                   `yaml:"Modules"`
+	PreInstallScripts    []Script                  `yaml:"PreInstallScripts"`
+	PostInstallScripts   []Script                  `yaml:"PostInstallScripts"`
+	FinalizeImageScripts []Script                  `yaml:"FinalizeImageScripts"`
+}
@@ -0,0 +1,24 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package imagecustomizerapi
+
+// User describes a single user account to create or update inside the chroot.
+type User struct {
+	Name                string   `yaml:"Name"`
+	UID                 *int     `yaml:"UID"`
+	Password            string   `yaml:"Password"`
+	PasswordPath        string   `yaml:"PasswordPath"`
+	PasswordHashed      bool     `yaml:"PasswordHashed"`
+	PasswordExpiresDays *int64   `yaml:"PasswordExpiresDays"`
+	PrimaryGroup        string   `yaml:"PrimaryGroup"`
+	PrimaryGroupGID     *int     `yaml:"PrimaryGroupGID"`
+	SecondaryGroups     []string `yaml:"SecondaryGroups"`
+	SSHPubKeyPaths      []string `yaml:"SSHPubKeyPaths"`
+	StartupCommand      string   `yaml:"StartupCommand"`
+	Shell               string   `yaml:"Shell"`
+	HomeDir             string   `yaml:"HomeDir"`
+	CreateHome          bool     `yaml:"CreateHome"`
+	Locked              bool     `yaml:"Locked"`
+	SudoersRules        []string `yaml:"SudoersRules"`
+}
@@ -4,12 +4,13 @@
 package imagecustomizerlib
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
 	"strconv"
+	"strings"
 
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/imagecustomizerapi"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/imagegen/installutils"
@@ -23,8 +24,13 @@ import (
 )
 
 const (
-	configDirMountPathInChroot = "/_imageconfigs"
-	resolveConfPath            = "/etc/resolv.conf"
+	configDirMountPathInChroot        = "/_imageconfigs"
+	inlineScriptsDirMountPathInChroot = "/_imagescripts"
+	resolveConfPath                   = "/etc/resolv.conf"
+	hostsFilePath                     = "/etc/hosts"
+
+	// hostsKeepMarker flags a line in the base image's /etc/hosts that should survive regeneration.
+	hostsKeepMarker = "# customizer:keep"
 )
 
 func doCustomizations(buildDir string, baseConfigPath string, config *imagecustomizerapi.Config,
@@ -35,7 +41,17 @@ func doCustomizations(buildDir string, baseConfigPath string, config *imagecusto
 	// Note: The ordering of the customization steps here should try to mirror the order of the equivalent steps in imager
 	// tool as closely as possible.
 
-	err = overrideResolvConf(imageChroot)
+	resolvConfSymlinkTarget, err := overrideResolvConf(config.SystemConfig.ResolvConf, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	err = runScripts(buildDir, baseConfigPath, config.SystemConfig.PreInstallScripts, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	repoCleanup, err := configureRepositories(baseConfigPath, config.SystemConfig.Repositories, imageChroot)
 	if err != nil {
 		return err
 	}
@@ -45,11 +61,21 @@ func doCustomizations(buildDir string, baseConfigPath string, config *imagecusto
 		return err
 	}
 
+	err = cleanupBuildTimeRepositories(repoCleanup, imageChroot)
+	if err != nil {
+		return err
+	}
+
 	err = updateHostname(config.SystemConfig.Hostname, imageChroot)
 	if err != nil {
 		return err
 	}
 
+	err = updateHosts(config.SystemConfig.HostsEntries, imageChroot)
+	if err != nil {
+		return err
+	}
+
 	err = copyAdditionalFiles(baseConfigPath, config.SystemConfig.AdditionalFiles, imageChroot)
 	if err != nil {
 		return err
@@ -70,17 +96,17 @@ func doCustomizations(buildDir string, baseConfigPath string, config *imagecusto
 		return err
 	}
 
-	err = runScripts(baseConfigPath, config.SystemConfig.PostInstallScripts, imageChroot)
+	err = runScripts(buildDir, baseConfigPath, config.SystemConfig.PostInstallScripts, imageChroot)
 	if err != nil {
 		return err
 	}
 
-	err = runScripts(baseConfigPath, config.SystemConfig.FinalizeImageScripts, imageChroot)
+	err = runScripts(buildDir, baseConfigPath, config.SystemConfig.FinalizeImageScripts, imageChroot)
 	if err != nil {
 		return err
 	}
 
-	err = deleteResolvConf(imageChroot)
+	err = deleteResolvConf(config.SystemConfig.ResolvConf, resolvConfSymlinkTarget, imageChroot)
 	if err != nil {
 		return err
 	}
@@ -90,31 +116,85 @@ func doCustomizations(buildDir string, baseConfigPath string, config *imagecusto
 
 // Override the resolv.conf file, so that in-chroot processes can access the network.
 // For example, to install packages from packages.microsoft.com.
-func overrideResolvConf(imageChroot *safechroot.Chroot) error {
+//
+// If the base image's resolv.conf is already a symlink (e.g. to systemd-resolved's or
+// NetworkManager's stub-resolv.conf), that target is returned so deleteResolvConf can restore it
+// once packages have been installed.
+func overrideResolvConf(resolvConf imagecustomizerapi.ResolvConf, imageChroot *safechroot.Chroot) (string, error) {
 	logger.Log.Debugf("Overriding resolv.conf file")
 
 	imageResolveConfPath := filepath.Join(imageChroot.RootDir(), resolveConfPath)
 
-	// Remove the existing resolv.conf file, if it exists.
-	// Note: It is assumed that the image will have a process that runs on boot that will override the resolv.conf
-	// file. For example, systemd-resolved. So, it isn't neccessary to make a back-up of the existing file.
-	err := os.RemoveAll(imageResolveConfPath)
+	symlinkTarget, err := readResolvConfSymlinkTarget(imageResolveConfPath)
 	if err != nil {
-		return fmt.Errorf("failed to delete existing resolv.conf file: %w", err)
+		return "", err
+	}
+
+	mode := resolvConf.Mode
+	if mode == "" {
+		mode = imagecustomizerapi.ResolvConfModeHost
+	}
+
+	if mode == imagecustomizerapi.ResolvConfModePreserve {
+		// Leave whatever the base image already has (file or symlink) untouched.
+		return "", nil
 	}
 
-	err = file.Copy(resolveConfPath, imageResolveConfPath)
+	err = os.RemoveAll(imageResolveConfPath)
 	if err != nil {
-		return fmt.Errorf("failed to override resolv.conf file with host's resolv.conf: %w", err)
+		return "", fmt.Errorf("failed to delete existing resolv.conf file: %w", err)
 	}
 
-	return nil
+	switch {
+	case mode == imagecustomizerapi.ResolvConfModeHost:
+		// Copy the build host's resolv.conf so that in-chroot processes (e.g. the package
+		// manager) can resolve names during customization.
+		err = file.Copy(resolveConfPath, imageResolveConfPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to override resolv.conf file with host's resolv.conf: %w", err)
+		}
+
+	case mode == imagecustomizerapi.ResolvConfModeGenerate:
+		err = file.Write(generateResolvConfContents(resolvConf), imageResolveConfPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate resolv.conf file: %w", err)
+		}
+
+	case strings.HasPrefix(mode, imagecustomizerapi.ResolvConfModeSymlinkToPrefix):
+		target := strings.TrimSpace(strings.TrimPrefix(mode, imagecustomizerapi.ResolvConfModeSymlinkToPrefix))
+		if target == "" {
+			return "", fmt.Errorf("unrecognized ResolvConf.Mode (%s): %q requires a target path", mode,
+				imagecustomizerapi.ResolvConfModeSymlinkToPrefix)
+		}
+		err = os.Symlink(target, imageResolveConfPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to symlink resolv.conf file to (%s): %w", target, err)
+		}
+
+	default:
+		return "", fmt.Errorf("unrecognized ResolvConf.Mode (%s)", mode)
+	}
+
+	return symlinkTarget, nil
 }
 
-// Delete the overridden resolv.conf file.
-// Note: It is assumed that the image will have a process that runs on boot that will override the resolv.conf
-// file. For example, systemd-resolved.
-func deleteResolvConf(imageChroot *safechroot.Chroot) error {
+// Delete the overridden resolv.conf file, restoring the base image's original symlink (if any).
+// Note: If the base image had no pre-existing resolv.conf symlink, it is assumed that the image
+// will have a process that runs on boot that will create/override it. For example, systemd-resolved.
+//
+// This only applies to "host" mode, which is scratch DNS access for the customization steps, not
+// the final image. "generate" and "symlink-to" produce the final /etc/resolv.conf and must be
+// left standing; "preserve" never touched the file in the first place.
+func deleteResolvConf(resolvConf imagecustomizerapi.ResolvConf, symlinkTarget string, imageChroot *safechroot.Chroot) error {
+	mode := resolvConf.Mode
+	if mode == "" {
+		mode = imagecustomizerapi.ResolvConfModeHost
+	}
+
+	if mode != imagecustomizerapi.ResolvConfModeHost {
+		return nil
+	}
+
 	logger.Log.Debugf("Deleting overridden resolv.conf file")
 
 	imageResolveConfPath := filepath.Join(imageChroot.RootDir(), resolveConfPath)
@@ -124,256 +204,1204 @@ func deleteResolvConf(imageChroot *safechroot.Chroot) error {
 		return fmt.Errorf("failed to delete overridden resolv.conf file: %w", err)
 	}
 
-	return err
+	if symlinkTarget != "" {
+		err = os.Symlink(symlinkTarget, imageResolveConfPath)
+		if err != nil {
+			return fmt.Errorf("failed to restore resolv.conf symlink (%s): %w", symlinkTarget, err)
+		}
+	}
+
+	return nil
 }
 
-func updateHostname(hostname string, imageChroot *safechroot.Chroot) error {
-	var err error
+// readResolvConfSymlinkTarget returns the target of path if it is a symlink, or "" otherwise.
+func readResolvConfSymlinkTarget(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to stat existing resolv.conf file: %w", err)
+	}
 
-	if hostname == "" {
-		return nil
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", nil
 	}
 
-	hostnameFilePath := filepath.Join(imageChroot.RootDir(), "etc/hostname")
-	err = file.Write(hostname, hostnameFilePath)
+	target, err := os.Readlink(path)
 	if err != nil {
-		return fmt.Errorf("failed to write hostname file: %w", err)
+		return "", fmt.Errorf("failed to read resolv.conf symlink target: %w", err)
 	}
 
-	return nil
+	return target, nil
 }
 
-func copyAdditionalFiles(baseConfigPath string, additionalFiles map[string]imagecustomizerapi.FileConfigList, imageChroot *safechroot.Chroot) error {
-	var err error
+// generateResolvConfContents renders a resolv.conf file from the configured nameservers, search
+// domains, and options.
+func generateResolvConfContents(resolvConf imagecustomizerapi.ResolvConf) string {
+	var lines []string
 
-	for sourceFile, fileConfigs := range additionalFiles {
-		for _, fileConfig := range fileConfigs {
-			fileToCopy := safechroot.FileToCopy{
-				Src:         filepath.Join(baseConfigPath, sourceFile),
-				Dest:        fileConfig.Path,
-				Permissions: (*fs.FileMode)(fileConfig.Permissions),
-			}
+	if len(resolvConf.Searches) > 0 {
+		lines = append(lines, "search "+strings.Join(resolvConf.Searches, " "))
+	}
 
-			err = imageChroot.AddFiles(fileToCopy)
-			if err != nil {
-				return err
-			}
-		}
+	for _, nameserver := range resolvConf.Nameservers {
+		lines = append(lines, "nameserver "+nameserver)
 	}
 
-	return nil
+	if len(resolvConf.Options) > 0 {
+		lines = append(lines, "options "+strings.Join(resolvConf.Options, " "))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
 }
 
-func runScripts(baseConfigPath string, scripts []imagecustomizerapi.Script, imageChroot *safechroot.Chroot) error {
-	if len(scripts) <= 0 {
-		return nil
-	}
+// repositoryCleanup carries the state configureRepositories needs cleanupBuildTimeRepositories to
+// undo once package installation has finished.
+type repositoryCleanup struct {
+	// RepoFiles are the in-chroot paths of repo files that were marked build-time-only.
+	RepoFiles []string
 
-	configDirMountPath := filepath.Join(imageChroot.RootDir(), configDirMountPathInChroot)
+	// GPGKeyPackages are the "gpg-pubkey-..." RPM package names that importGPGKey newly trusted
+	// for keys marked build-time-only.
+	GPGKeyPackages []string
+}
 
-	// Bind mount the config directory so that the scripts can access any required resources.
-	mount, err := safemount.NewMount(baseConfigPath, configDirMountPath, "", unix.MS_BIND|unix.MS_RDONLY, "", true)
-	if err != nil {
-		return err
-	}
-	defer mount.Close()
+// configureRepositories drops .repo files and imports GPG keys into the chroot ahead of package
+// installation, and toggles existing repos on/off by ID. It returns what cleanupBuildTimeRepositories
+// needs to undo anything marked build-time-only once package installation has finished.
+func configureRepositories(baseConfigPath string, repositories imagecustomizerapi.Repositories, imageChroot *safechroot.Chroot) (repositoryCleanup, error) {
+	var cleanup repositoryCleanup
+
+	for _, repo := range repositories.Repos {
+		if repo.BuildTimeOnly && repo.Content == "" && repo.Path == "" {
+			// There's no file to remove afterwards, and reliably restoring the repo's prior
+			// enabled/disabled state would require re-deriving it from dnf, so this is rejected
+			// rather than silently left permanently toggled.
+			return repositoryCleanup{}, fmt.Errorf(
+				"repo (%s): BuildTimeOnly is not supported when only toggling an existing repo's Enabled state", repo.ID)
+		}
 
-	for _, script := range scripts {
-		scriptPathInChroot := filepath.Join(configDirMountPathInChroot, script.Path)
-		command := fmt.Sprintf("%s %s", scriptPathInChroot, script.Args)
+		repoFilePathInChroot, err := writeRepoFile(baseConfigPath, repo, imageChroot)
+		if err != nil {
+			return repositoryCleanup{}, err
+		}
 
-		// Run the script.
-		err = imageChroot.UnsafeRun(func() error {
-			err := shell.ExecuteLive(false, shell.ShellProgram, "-c", command)
+		if repo.Enabled != nil {
+			err = setRepoEnabled(repo.ID, *repo.Enabled, imageChroot)
 			if err != nil {
-				return err
+				return repositoryCleanup{}, err
 			}
+		}
 
-			return nil
-		})
-		if err != nil {
-			return err
+		if repo.BuildTimeOnly && repoFilePathInChroot != "" {
+			cleanup.RepoFiles = append(cleanup.RepoFiles, repoFilePathInChroot)
 		}
 	}
 
-	err = mount.CleanClose()
-	if err != nil {
-		return err
+	for _, key := range repositories.GPGKeys {
+		gpgKeyPackage, err := importGPGKey(baseConfigPath, key, imageChroot)
+		if err != nil {
+			return repositoryCleanup{}, err
+		}
+
+		if key.BuildTimeOnly && gpgKeyPackage != "" {
+			cleanup.GPGKeyPackages = append(cleanup.GPGKeyPackages, gpgKeyPackage)
+		}
 	}
 
-	return nil
+	return cleanup, nil
 }
 
-func addOrUpdateUsers(users []imagecustomizerapi.User, baseConfigPath string, imageChroot *safechroot.Chroot) error {
-	for _, user := range users {
-		err := addOrUpdateUser(user, baseConfigPath, imageChroot)
+// writeRepoFile writes repo's inline Content or the file at its config-relative Path to
+// /etc/yum.repos.d, returning the file's in-chroot path. If neither is set, repo.ID is assumed to
+// refer to an already-shipped repo that is only being toggled on/off, and "" is returned.
+func writeRepoFile(baseConfigPath string, repo imagecustomizerapi.Repository, imageChroot *safechroot.Chroot) (string, error) {
+	var content string
+	switch {
+	case repo.Content != "":
+		content = repo.Content
+	case repo.Path != "":
+		contents, err := os.ReadFile(filepath.Join(baseConfigPath, repo.Path))
 		if err != nil {
-			return err
+			return "", fmt.Errorf("failed to read repo file (%s): %w", repo.Path, err)
 		}
+		content = string(contents)
+	default:
+		return "", nil
 	}
 
-	return nil
+	logger.Log.Infof("Adding repo (%s)", repo.ID)
+
+	repoFileName := repo.ID
+	if !strings.HasSuffix(repoFileName, ".repo") {
+		repoFileName += ".repo"
+	}
+	repoFilePathInChroot := filepath.Join("/etc/yum.repos.d", repoFileName)
+
+	err := file.Write(content, filepath.Join(imageChroot.RootDir(), repoFilePathInChroot))
+	if err != nil {
+		return "", fmt.Errorf("failed to write repo file (%s): %w", repoFileName, err)
+	}
+
+	return repoFilePathInChroot, nil
 }
 
-func addOrUpdateUser(user imagecustomizerapi.User, baseConfigPath string, imageChroot *safechroot.Chroot) error {
-	var err error
+// setRepoEnabled toggles an existing repo definition on or off by ID.
+func setRepoEnabled(repoID string, enabled bool, imageChroot *safechroot.Chroot) error {
+	flag := "--set-enabled"
+	if !enabled {
+		flag = "--set-disabled"
+	}
 
-	logger.Log.Infof("Adding/updating user (%s)", user.Name)
+	err := imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, "dnf", "config-manager", flag, repoID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to toggle repo (%s): %w", repoID, err)
+	}
 
-	password := user.Password
-	if user.PasswordPath != "" {
-		// Read password from file.
-		passwordFullPath := filepath.Join(baseConfigPath, user.PasswordPath)
+	return nil
+}
 
-		passwordFileContents, err := os.ReadFile(passwordFullPath)
+// importGPGKey imports a GPG key file, found at key.Path relative to baseConfigPath, into the
+// chroot's RPM database. If key.BuildTimeOnly is set and the key wasn't already trusted, the
+// name of the newly-added "gpg-pubkey" package is returned so it can be untrusted again later;
+// otherwise "" is returned.
+func importGPGKey(baseConfigPath string, key imagecustomizerapi.GPGKey, imageChroot *safechroot.Chroot) (string, error) {
+	logger.Log.Infof("Importing GPG key (%s)", key.Path)
+
+	var trustedBefore map[string]bool
+	if key.BuildTimeOnly {
+		var err error
+		trustedBefore, err = rpmGPGPubkeyPackages(imageChroot)
 		if err != nil {
-			return fmt.Errorf("failed to read password file (%s): %w", passwordFullPath, err)
+			return "", err
 		}
+	}
 
-		password = string(passwordFileContents)
+	keyPathInChroot := filepath.Join("/tmp", filepath.Base(key.Path))
+
+	fileToCopy := safechroot.FileToCopy{
+		Src:  filepath.Join(baseConfigPath, key.Path),
+		Dest: keyPathInChroot,
+	}
+	err := imageChroot.AddFiles(fileToCopy)
+	if err != nil {
+		return "", err
 	}
 
-	// Hash the password.
-	hashedPassword := password
-	if !user.PasswordHashed {
-		hashedPassword, err = userutils.HashPassword(user.Password)
-		if err != nil {
-			return err
-		}
+	err = imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, "rpm", "--import", keyPathInChroot)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to import GPG key (%s): %w", key.Path, err)
 	}
 
-	// Check if the user already exists.
-	userExists, err := userutils.UserExists(user.Name, imageChroot)
+	err = os.RemoveAll(filepath.Join(imageChroot.RootDir(), keyPathInChroot))
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to remove temporary GPG key file (%s): %w", keyPathInChroot, err)
 	}
 
-	if userExists {
-		// Update the user's password.
-		err = installutils.UpdateUserPassword(imageChroot.RootDir(), user.Name, hashedPassword)
+	if !key.BuildTimeOnly {
+		return "", nil
+	}
+
+	trustedAfter, err := rpmGPGPubkeyPackages(imageChroot)
+	if err != nil {
+		return "", err
+	}
+
+	for gpgKeyPackage := range trustedAfter {
+		if !trustedBefore[gpgKeyPackage] {
+			return gpgKeyPackage, nil
+		}
+	}
+
+	// The key was already trusted before this import (e.g. shipped by the base image), so there
+	// is nothing newly-added to untrust afterwards.
+	return "", nil
+}
+
+// rpmGPGPubkeyPackages returns the set of "gpg-pubkey" package names currently trusted in the
+// chroot's RPM database.
+func rpmGPGPubkeyPackages(imageChroot *safechroot.Chroot) (map[string]bool, error) {
+	packages := make(map[string]bool)
+
+	err := imageChroot.UnsafeRun(func() error {
+		stdout, stderr, err := shell.ExecuteAndCaptureOutput("rpm", "-qa", "gpg-pubkey")
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to list trusted GPG keys:\n%w\n%s", err, stderr)
 		}
-	} else {
-		var uidStr string
-		if user.UID != nil {
-			uidStr = strconv.Itoa(*user.UID)
+
+		for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+			if line != "" {
+				packages[line] = true
+			}
 		}
 
-		// Add the user.
-		err = userutils.AddUser(user.Name, hashedPassword, uidStr, imageChroot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// cleanupBuildTimeRepositories removes repo files and untrusts GPG keys that were marked
+// build-time-only, once package installation has finished. This mirrors deleteResolvConf's
+// clean-up-after-use pattern.
+func cleanupBuildTimeRepositories(cleanup repositoryCleanup, imageChroot *safechroot.Chroot) error {
+	for _, repoFilePathInChroot := range cleanup.RepoFiles {
+		err := os.RemoveAll(filepath.Join(imageChroot.RootDir(), repoFilePathInChroot))
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to remove build-time-only repo file (%s): %w", repoFilePathInChroot, err)
 		}
 	}
 
-	// Set user's password expiry.
-	if user.PasswordExpiresDays != nil {
-		err = installutils.Chage(imageChroot, *user.PasswordExpiresDays, user.Name)
+	for _, gpgKeyPackage := range cleanup.GPGKeyPackages {
+		err := imageChroot.UnsafeRun(func() error {
+			return shell.ExecuteLive(false, "rpm", "-e", gpgKeyPackage)
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to untrust build-time-only GPG key (%s): %w", gpgKeyPackage, err)
 		}
 	}
 
-	// Set user's groups.
-	err = installutils.ConfigureUserGroupMembership(imageChroot, user.Name, user.PrimaryGroup, user.SecondaryGroups)
+	return nil
+}
+
+func updateHostname(hostname string, imageChroot *safechroot.Chroot) error {
+	var err error
+
+	if hostname == "" {
+		return nil
+	}
+
+	hostnameFilePath := filepath.Join(imageChroot.RootDir(), "etc/hostname")
+	err = file.Write(hostname, hostnameFilePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write hostname file: %w", err)
 	}
 
-	// Set user's SSH keys.
-	err = installutils.ProvisionUserSSHCerts(imageChroot, user.Name, user.SSHPubKeyPaths)
+	return nil
+}
+
+// updateHosts regenerates /etc/hosts from the configured entries, merging them with a default
+// localhost block and any lines in the base image that are marked to be kept.
+func updateHosts(hostsEntries []imagecustomizerapi.HostsEntry, imageChroot *safechroot.Chroot) error {
+	if len(hostsEntries) <= 0 {
+		return nil
+	}
+
+	logger.Log.Infof("Updating hosts file")
+
+	imageHostsFilePath := filepath.Join(imageChroot.RootDir(), hostsFilePath)
+
+	keptLines, err := readKeptHostsLines(imageHostsFilePath)
 	if err != nil {
 		return err
 	}
 
-	// Set user's startup command.
-	err = installutils.ConfigureUserStartupCommand(imageChroot, user.Name, user.StartupCommand)
+	var lines []string
+	lines = append(lines,
+		"127.0.0.1 localhost",
+		"::1       localhost",
+	)
+	lines = append(lines, keptLines...)
+
+	for _, entry := range hostsEntries {
+		line := fmt.Sprintf("%s %s", entry.IP, strings.Join(entry.Hostnames, " "))
+		if entry.Comment != "" {
+			line = fmt.Sprintf("%s # %s", line, entry.Comment)
+		}
+		lines = append(lines, line)
+	}
+
+	data := strings.Join(lines, "\n") + "\n"
+	err = file.Write(data, imageHostsFilePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write hosts file: %w", err)
 	}
 
 	return nil
 }
 
-func enableOrDisableServices(services imagecustomizerapi.Services, imageChroot *safechroot.Chroot) error {
-	var err error
-
-	// Handle enabling services
-	for _, service := range services.Enable {
-		logger.Log.Infof("Enabling service (%s)", service.Name)
-
-		err = imageChroot.UnsafeRun(func() error {
-			err := shell.ExecuteLive(false, "systemctl", "enable", service.Name)
-			if err != nil {
-				return fmt.Errorf("failed to enable service (%s): \n%w", service.Name, err)
-			}
+// readKeptHostsLines returns the lines of an existing /etc/hosts file that are marked with
+// hostsKeepMarker, so that they survive regeneration.
+func readKeptHostsLines(imageHostsFilePath string) ([]string, error) {
+	existingContents, err := os.ReadFile(imageHostsFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read existing hosts file: %w", err)
+	}
 
-			return nil
-		})
-		if err != nil {
-			return err
+	var keptLines []string
+	for _, line := range strings.Split(string(existingContents), "\n") {
+		if strings.Contains(line, hostsKeepMarker) {
+			keptLines = append(keptLines, line)
 		}
 	}
 
-	// Handle disabling services
-	for _, service := range services.Disable {
-		logger.Log.Infof("Disabling service (%s)", service.Name)
+	return keptLines, nil
+}
 
-		err = imageChroot.UnsafeRun(func() error {
-			err := shell.ExecuteLive(false, "systemctl", "disable", service.Name)
+func copyAdditionalFiles(baseConfigPath string, additionalFiles map[string]imagecustomizerapi.FileConfigList, imageChroot *safechroot.Chroot) error {
+	for sourceFile, fileConfigs := range additionalFiles {
+		for _, fileConfig := range fileConfigs {
+			err := copyAdditionalFile(baseConfigPath, sourceFile, fileConfig, imageChroot)
 			if err != nil {
-				return fmt.Errorf("failed to disable service (%s): %w", service.Name, err)
+				return err
 			}
-
-			return nil
-		})
-		if err != nil {
-			return err
 		}
 	}
 
 	return nil
 }
 
-func loadOrDisableModules(modules imagecustomizerapi.Modules, imageChroot *safechroot.Chroot) error {
-	var err error
+// copyAdditionalFile copies a single AdditionalFiles entry into the chroot. If sourceFile is a
+// glob pattern, every match is copied into fileConfig.Path (treated as a destination directory);
+// otherwise sourceFile is copied directly to fileConfig.Path (treated as a destination file).
+func copyAdditionalFile(baseConfigPath string, sourceFile string, fileConfig imagecustomizerapi.FileConfig,
+	imageChroot *safechroot.Chroot,
+) error {
+	sourcePattern := filepath.Join(baseConfigPath, sourceFile)
 
-	for _, module := range modules.Load {
-		logger.Log.Infof("Loading kernel module (%s)", module.Name)
-		moduleFileName := module.Name + ".conf"
-		moduleFilePath := filepath.Join(imageChroot.RootDir(), "/etc/modules-load.d/", moduleFileName)
-		err = file.Write(module.Name, moduleFilePath)
+	if !isGlobPattern(sourceFile) {
+		return copyAdditionalFileToDest(sourcePattern, fileConfig.Path, fileConfig, imageChroot)
+	}
+
+	matches, err := filepath.Glob(sourcePattern)
+	if err != nil {
+		return fmt.Errorf("failed to expand glob (%s): %w", sourcePattern, err)
+	}
+
+	for _, match := range matches {
+		info, err := os.Lstat(match)
 		if err != nil {
-			return fmt.Errorf("failed to write module load configuration: %w", err)
+			return fmt.Errorf("failed to stat glob match (%s): %w", match, err)
 		}
 
-		if module.Options != nil {
-			var options []string
-			for key, value := range module.Options {
-				options = append(options, fmt.Sprintf("%s=%s", key, value))
-			}
+		dest := filepath.Join(fileConfig.Path, filepath.Base(match))
 
-			moduleOptionsFileName := module.Name + "-options.conf"
-			moduleOptionsFilePath := filepath.Join(imageChroot.RootDir(), "/etc/modprobe.d/", moduleOptionsFileName)
-			data := fmt.Sprintf("options %s %s\n", module.Name, strings.Join(options, " "))
-			err = file.Write(data, moduleOptionsFilePath)
-			if err != nil {
-				return fmt.Errorf("failed to write module options configuration: %w", err)
+		switch {
+		case info.Mode().IsRegular():
+			err = copyAdditionalFileToDest(match, dest, fileConfig, imageChroot)
+
+		case info.IsDir():
+			if !fileConfig.Recursive {
+				return fmt.Errorf("glob match (%s) is a directory but Recursive is not set", match)
 			}
+			err = copyAdditionalDirToDest(match, dest, fileConfig, imageChroot)
+
+		default:
+			return fmt.Errorf("glob match (%s) is not a regular file or directory", match)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyAdditionalDirToDest recursively copies the contents of srcDir into destDir inside the chroot.
+func copyAdditionalDirToDest(srcDir string, destDir string, fileConfig imagecustomizerapi.FileConfig,
+	imageChroot *safechroot.Chroot,
+) error {
+	return filepath.WalkDir(srcDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(destDir, relPath)
+
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(imageChroot.RootDir(), dest), 0o755)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("(%s) is not a regular file or directory", path)
+		}
+
+		return copyAdditionalFileToDest(path, dest, fileConfig, imageChroot)
+	})
+}
+
+// copyAdditionalFileToDest copies a single regular file into the chroot at dest, creating
+// intermediate directories at 0755, then applies the configured ownership and SELinux label.
+func copyAdditionalFileToDest(src string, dest string, fileConfig imagecustomizerapi.FileConfig,
+	imageChroot *safechroot.Chroot,
+) error {
+	fileToCopy := safechroot.FileToCopy{
+		Src:         src,
+		Dest:        dest,
+		Permissions: (*fs.FileMode)(fileConfig.Permissions),
+	}
+
+	err := imageChroot.AddFiles(fileToCopy)
+	if err != nil {
+		return err
+	}
+
+	err = setAdditionalFileOwner(dest, fileConfig, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	if fileConfig.SELinuxLabel != "" {
+		err = imageChroot.UnsafeRun(func() error {
+			return shell.ExecuteLive(false, "chcon", fileConfig.SELinuxLabel, dest)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set SELinux label (%s) on (%s): %w", fileConfig.SELinuxLabel, dest, err)
+		}
+	}
+
+	return nil
+}
+
+// setAdditionalFileOwner chowns dest inside the chroot to the configured Owner/Group, resolving
+// either a numeric ID or a name looked up against the chroot's /etc/passwd and /etc/group.
+func setAdditionalFileOwner(dest string, fileConfig imagecustomizerapi.FileConfig, imageChroot *safechroot.Chroot) error {
+	if fileConfig.Owner == "" && fileConfig.Group == "" {
+		return nil
+	}
+
+	uid := -1
+	if fileConfig.Owner != "" {
+		resolvedUID, err := resolveChrootID(imageChroot, "/etc/passwd", fileConfig.Owner)
+		if err != nil {
+			return fmt.Errorf("failed to resolve owner (%s): %w", fileConfig.Owner, err)
+		}
+		uid = resolvedUID
+	}
+
+	gid := -1
+	if fileConfig.Group != "" {
+		resolvedGID, err := resolveChrootID(imageChroot, "/etc/group", fileConfig.Group)
+		if err != nil {
+			return fmt.Errorf("failed to resolve group (%s): %w", fileConfig.Group, err)
+		}
+		gid = resolvedGID
+	}
+
+	destFullPath := filepath.Join(imageChroot.RootDir(), dest)
+	err := os.Chown(destFullPath, uid, gid)
+	if err != nil {
+		return fmt.Errorf("failed to chown (%s): %w", dest, err)
+	}
+
+	return nil
+}
+
+// resolveChrootID resolves a numeric or named user/group against a chroot's /etc/passwd or
+// /etc/group file, returning the numeric ID.
+func resolveChrootID(imageChroot *safechroot.Chroot, chrootDbFile string, nameOrID string) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+
+	dbFilePath := filepath.Join(imageChroot.RootDir(), chrootDbFile)
+	contents, err := os.ReadFile(dbFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read (%s): %w", chrootDbFile, err)
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+
+		if fields[0] == nameOrID {
+			id, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return 0, fmt.Errorf("malformed entry for (%s) in (%s): %w", nameOrID, chrootDbFile, err)
+			}
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no entry for (%s) found in (%s)", nameOrID, chrootDbFile)
+}
+
+// isGlobPattern reports whether path contains any filepath.Glob meta-characters.
+func isGlobPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+func runScripts(buildDir string, baseConfigPath string, scripts []imagecustomizerapi.Script, imageChroot *safechroot.Chroot) error {
+	if len(scripts) <= 0 {
+		return nil
+	}
+
+	configDirMountPath := filepath.Join(imageChroot.RootDir(), configDirMountPathInChroot)
+
+	// Bind mount the config directory so that the scripts can access any required resources.
+	mount, err := safemount.NewMount(baseConfigPath, configDirMountPath, "", unix.MS_BIND|unix.MS_RDONLY, "", true)
+	if err != nil {
+		return err
+	}
+	defer mount.Close()
+
+	// Inline (Content) scripts are written out under buildDir, not baseConfigPath, since the
+	// latter is the caller's own config directory and may not even be writable by the build user.
+	inlineScriptsDir := filepath.Join(buildDir, "customizer-inline-scripts")
+	err = os.MkdirAll(inlineScriptsDir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create inline scripts directory: %w", err)
+	}
+	defer os.RemoveAll(inlineScriptsDir)
+
+	inlineScriptsMountPath := filepath.Join(imageChroot.RootDir(), inlineScriptsDirMountPathInChroot)
+	inlineMount, err := safemount.NewMount(inlineScriptsDir, inlineScriptsMountPath, "", unix.MS_BIND|unix.MS_RDONLY, "", true)
+	if err != nil {
+		return err
+	}
+	defer inlineMount.Close()
+
+	for _, script := range scripts {
+		err = runScript(inlineScriptsDir, script, imageChroot)
+		if err != nil {
+			if script.ContinueOnError {
+				logger.Log.Warnf("script (%s) failed, continuing: %v", scriptLabel(script), err)
+				continue
+			}
+			return err
+		}
+	}
+
+	err = inlineMount.CleanClose()
+	if err != nil {
+		return err
+	}
+
+	err = mount.CleanClose()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// runScript executes a single script inside the chroot, applying its interpreter, environment,
+// working directory, and timeout, and logs its path/label for debuggability.
+func runScript(inlineScriptsDir string, script imagecustomizerapi.Script, imageChroot *safechroot.Chroot) error {
+	interpreter := script.Interpreter
+	if interpreter == "" {
+		interpreter = "/bin/sh"
+	}
+
+	scriptPathInChroot, cleanup, err := resolveScriptPath(inlineScriptsDir, script)
+	if err != nil {
+		return err
+	}
+	if cleanup != nil {
+		defer cleanup()
+	}
+
+	logger.Log.Infof("Running script (%s)", scriptLabel(script))
+
+	var parts []string
+	if script.WorkingDir != "" {
+		parts = append(parts, fmt.Sprintf("cd %s", shellQuote(script.WorkingDir)))
+	}
+	for key, value := range script.Env {
+		parts = append(parts, fmt.Sprintf("export %s=%s", key, shellQuote(value)))
+	}
+	parts = append(parts, fmt.Sprintf("%s %s %s", interpreter, scriptPathInChroot, script.Args))
+	command := strings.Join(parts, " && ")
+
+	if script.TimeoutSeconds > 0 {
+		command = fmt.Sprintf("timeout %ds sh -c %s", script.TimeoutSeconds, shellQuote(command))
+	}
+
+	err = imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, shell.ShellProgram, "-c", command)
+	})
+	if err != nil {
+		return fmt.Errorf("script (%s) failed: %w", scriptLabel(script), err)
+	}
+
+	return nil
+}
+
+// resolveScriptPath returns the in-chroot path to the script to run, writing out script.Content
+// to a temp file under the bind-mounted scratch scripts directory if the script is inline. The
+// returned cleanup function (if non-nil) removes that temp file and must be called once the
+// script has run.
+func resolveScriptPath(inlineScriptsDir string, script imagecustomizerapi.Script) (string, func(), error) {
+	if script.Content == "" {
+		return filepath.Join(configDirMountPathInChroot, script.Path), nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(script.Content))
+	tempFileName := fmt.Sprintf("inline-%x.sh", sum)
+	tempFilePath := filepath.Join(inlineScriptsDir, tempFileName)
+
+	err := file.Write(script.Content, tempFilePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to write inline script (%s): %w", tempFileName, err)
+	}
+
+	err = os.Chmod(tempFilePath, 0o755)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to set inline script (%s) as executable: %w", tempFileName, err)
+	}
+
+	cleanup := func() {
+		os.Remove(tempFilePath)
+	}
+
+	return filepath.Join(inlineScriptsDirMountPathInChroot, tempFileName), cleanup, nil
+}
+
+// scriptLabel returns a human-readable identifier for a script, for use in logs and errors.
+func scriptLabel(script imagecustomizerapi.Script) string {
+	if script.Path != "" {
+		return script.Path
+	}
+	return "<inline script>"
+}
+
+// shellQuote wraps s in single quotes, suitable for safe interpolation into a shell -c command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func addOrUpdateUsers(users []imagecustomizerapi.User, baseConfigPath string, imageChroot *safechroot.Chroot) error {
+	for _, user := range users {
+		err := addOrUpdateUser(user, baseConfigPath, imageChroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addOrUpdateUser(user imagecustomizerapi.User, baseConfigPath string, imageChroot *safechroot.Chroot) error {
+	var err error
+
+	logger.Log.Infof("Adding/updating user (%s)", user.Name)
+
+	password := user.Password
+	if user.PasswordPath != "" {
+		// Read password from file.
+		passwordFullPath := filepath.Join(baseConfigPath, user.PasswordPath)
+
+		passwordFileContents, err := os.ReadFile(passwordFullPath)
+		if err != nil {
+			return fmt.Errorf("failed to read password file (%s): %w", passwordFullPath, err)
+		}
+
+		password = string(passwordFileContents)
+	}
+
+	// Hash the password.
+	hashedPassword := password
+	if !user.PasswordHashed {
+		hashedPassword, err = userutils.HashPassword(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	// If a fixed GID was requested for the user's primary group, create/reconcile that group
+	// before the user is created, since useradd needs it to already exist.
+	if user.PrimaryGroupGID != nil {
+		err = ensurePrimaryGroupGID(user.PrimaryGroup, *user.PrimaryGroupGID, imageChroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check if the user already exists.
+	userExists, err := userutils.UserExists(user.Name, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	if userExists {
+		// Update the user's password.
+		err = installutils.UpdateUserPassword(imageChroot.RootDir(), user.Name, hashedPassword)
+		if err != nil {
+			return err
+		}
+	} else {
+		var uidStr string
+		if user.UID != nil {
+			uidStr = strconv.Itoa(*user.UID)
+		}
+
+		// Add the user.
+		err = userutils.AddUser(user.Name, hashedPassword, uidStr, imageChroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set user's password expiry.
+	if user.PasswordExpiresDays != nil {
+		err = installutils.Chage(imageChroot, *user.PasswordExpiresDays, user.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set user's groups.
+	err = installutils.ConfigureUserGroupMembership(imageChroot, user.Name, user.PrimaryGroup, user.SecondaryGroups)
+	if err != nil {
+		return err
+	}
+
+	// Set user's shell. Applied via usermod so it works whether the user was just created or
+	// already existed.
+	if user.Shell != "" {
+		err = configureUserShell(user.Name, user.Shell, imageChroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set user's home directory.
+	if user.HomeDir != "" {
+		err = configureUserHomeDir(user.Name, user.HomeDir, user.CreateHome, userExists, imageChroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set user's SSH keys.
+	err = installutils.ProvisionUserSSHCerts(imageChroot, user.Name, user.SSHPubKeyPaths)
+	if err != nil {
+		return err
+	}
+
+	// Set user's startup command.
+	err = installutils.ConfigureUserStartupCommand(imageChroot, user.Name, user.StartupCommand)
+	if err != nil {
+		return err
+	}
+
+	// Lock the account, if requested.
+	if user.Locked {
+		err = imageChroot.UnsafeRun(func() error {
+			return shell.ExecuteLive(false, "passwd", "-l", user.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to lock user account (%s): %w", user.Name, err)
+		}
+	}
+
+	// Grant sudo rules, if any.
+	err = configureUserSudoers(user, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ensurePrimaryGroupGID creates groupName with the given GID, or updates its GID if the group
+// already exists.
+func ensurePrimaryGroupGID(groupName string, gid int, imageChroot *safechroot.Chroot) error {
+	if groupName == "" {
+		return fmt.Errorf("PrimaryGroupGID requires PrimaryGroup to also be set")
+	}
+
+	command := "groupadd"
+	if _, err := resolveChrootID(imageChroot, "/etc/group", groupName); err == nil {
+		command = "groupmod"
+	}
+
+	err := imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, command, "-g", strconv.Itoa(gid), groupName)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure primary group (%s) with GID (%d): %w", groupName, gid, err)
+	}
+
+	return nil
+}
+
+// configureUserShell validates that shellPath is a permitted login shell in the chroot, and sets
+// it as the user's shell.
+func configureUserShell(userName string, shellPath string, imageChroot *safechroot.Chroot) error {
+	shellsFilePath := filepath.Join(imageChroot.RootDir(), "/etc/shells")
+	contents, err := os.ReadFile(shellsFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read /etc/shells: %w", err)
+	}
+
+	valid := false
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == shellPath {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("shell (%s) is not listed in /etc/shells", shellPath)
+	}
+
+	err = imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, "usermod", "-s", shellPath, userName)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set shell (%s) for user (%s): %w", shellPath, userName, err)
+	}
+
+	return nil
+}
+
+// configureUserHomeDir sets the user's home directory, optionally creating and populating it from
+// /etc/skel.
+//
+// "usermod -m" only moves the contents of an existing old home directory to the new location; per
+// shadow-utils, if the old home directory doesn't exist, the new one is not created. A freshly
+// useradd'd account has no home directory yet, so for new users the home directory is created
+// directly instead of relying on "usermod -m".
+func configureUserHomeDir(userName string, homeDir string, createHome bool, userExists bool, imageChroot *safechroot.Chroot) error {
+	if !userExists {
+		err := imageChroot.UnsafeRun(func() error {
+			return shell.ExecuteLive(false, "usermod", "-d", homeDir, userName)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set home directory (%s) for user (%s): %w", homeDir, userName, err)
+		}
+
+		if createHome {
+			err = createUserHomeDir(userName, homeDir, imageChroot)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	args := []string{"-d", homeDir}
+	if createHome {
+		args = append(args, "-m")
+	}
+	args = append(args, userName)
+
+	err := imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, "usermod", args...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set home directory (%s) for user (%s): %w", homeDir, userName, err)
+	}
+
+	return nil
+}
+
+// createUserHomeDir creates homeDir, populates it from /etc/skel (if present), and sets its
+// ownership to userName.
+func createUserHomeDir(userName string, homeDir string, imageChroot *safechroot.Chroot) error {
+	homeDirFullPath := filepath.Join(imageChroot.RootDir(), homeDir)
+
+	err := os.MkdirAll(homeDirFullPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create home directory (%s) for user (%s): %w", homeDir, userName, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(imageChroot.RootDir(), "/etc/skel")); err == nil {
+		err = imageChroot.UnsafeRun(func() error {
+			return shell.ExecuteLive(false, "cp", "-rT", "/etc/skel", homeDir)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to populate home directory (%s) from /etc/skel for user (%s): %w",
+				homeDir, userName, err)
+		}
+	}
+
+	err = imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, "chown", "-R", fmt.Sprintf("%s:%s", userName, userName), homeDir)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ownership on home directory (%s) for user (%s): %w", homeDir, userName, err)
+	}
+
+	return nil
+}
+
+// configureUserSudoers writes user.SudoersRules atomically to /etc/sudoers.d/<user> with mode
+// 0440, validating the result with visudo before leaving it in place.
+func configureUserSudoers(user imagecustomizerapi.User, imageChroot *safechroot.Chroot) error {
+	if len(user.SudoersRules) <= 0 {
+		return nil
+	}
+
+	sudoersPathInChroot := filepath.Join("/etc/sudoers.d", user.Name)
+	sudoersFullPath := filepath.Join(imageChroot.RootDir(), sudoersPathInChroot)
+	tempFullPath := sudoersFullPath + ".tmp"
+
+	data := strings.Join(user.SudoersRules, "\n") + "\n"
+	err := file.Write(data, tempFullPath)
+	if err != nil {
+		return fmt.Errorf("failed to write sudoers rules for user (%s): %w", user.Name, err)
+	}
+
+	err = os.Chmod(tempFullPath, 0o440)
+	if err != nil {
+		return fmt.Errorf("failed to set permissions on sudoers file for user (%s): %w", user.Name, err)
+	}
+
+	err = os.Rename(tempFullPath, sudoersFullPath)
+	if err != nil {
+		return fmt.Errorf("failed to install sudoers file for user (%s): %w", user.Name, err)
+	}
+
+	err = imageChroot.UnsafeRun(func() error {
+		return shell.ExecuteLive(false, "visudo", "-c", "-f", sudoersPathInChroot)
+	})
+	if err != nil {
+		os.RemoveAll(sudoersFullPath)
+		return fmt.Errorf("invalid sudoers rules for user (%s): %w", user.Name, err)
+	}
+
+	return nil
+}
+
+func enableOrDisableServices(services imagecustomizerapi.Services, imageChroot *safechroot.Chroot) error {
+	var err error
+
+	// Handle enabling services
+	for _, service := range services.Enable {
+		logger.Log.Infof("Enabling service (%s)", service.Name)
+
+		err = imageChroot.UnsafeRun(func() error {
+			err := shell.ExecuteLive(false, "systemctl", "enable", service.Name)
+			if err != nil {
+				return fmt.Errorf("failed to enable service (%s): \n%w", service.Name, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Handle disabling services
+	for _, service := range services.Disable {
+		logger.Log.Infof("Disabling service (%s)", service.Name)
+
+		err = imageChroot.UnsafeRun(func() error {
+			err := shell.ExecuteLive(false, "systemctl", "disable", service.Name)
+			if err != nil {
+				return fmt.Errorf("failed to disable service (%s): %w", service.Name, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadOrDisableModules(modules imagecustomizerapi.Modules, imageChroot *safechroot.Chroot) error {
+	for _, module := range modules.Load {
+		err := loadModule(module, imageChroot)
+		if err != nil {
+			return err
 		}
 	}
 
 	for _, module := range modules.Disable {
-		logger.Log.Infof("Disabling kernel module (%s)", module.Name)
-		moduleFileName := module.Name + ".conf"
-		moduleFilePath := filepath.Join(imageChroot.RootDir(), "/etc/modprobe.d/", moduleFileName)
-		data := fmt.Sprintf("blacklist %s\n", module.Name)
-		err = file.Write(data, moduleFilePath)
+		err := disableModule(module, imageChroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadModule(module imagecustomizerapi.Module, imageChroot *safechroot.Chroot) error {
+	logger.Log.Infof("Loading kernel module (%s)", module.Name)
+
+	err := validateModuleExists(module.Name, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	moduleFileName := module.Name + ".conf"
+	if module.Order != 0 {
+		moduleFileName = fmt.Sprintf("%02d-%s.conf", module.Order, module.Name)
+	}
+	moduleFilePath := filepath.Join(imageChroot.RootDir(), "/etc/modules-load.d/", moduleFileName)
+	err = mergeConfigLines(moduleFilePath, []string{module.Name})
+	if err != nil {
+		return fmt.Errorf("failed to write module load configuration: %w", err)
+	}
+
+	modprobeLines := moduleOptionsLines(module)
+	if len(modprobeLines) > 0 {
+		moduleOptionsFileName := module.Name + "-options.conf"
+		moduleOptionsFilePath := filepath.Join(imageChroot.RootDir(), "/etc/modprobe.d/", moduleOptionsFileName)
+		err = mergeConfigLines(moduleOptionsFilePath, modprobeLines)
 		if err != nil {
-			return fmt.Errorf("failed to write module disable configuration: %w", err)
+			return fmt.Errorf("failed to write module options configuration: %w", err)
 		}
 	}
 
 	return nil
 }
+
+func disableModule(module imagecustomizerapi.Module, imageChroot *safechroot.Chroot) error {
+	logger.Log.Infof("Disabling kernel module (%s)", module.Name)
+
+	err := validateModuleExists(module.Name, imageChroot)
+	if err != nil {
+		return err
+	}
+
+	moduleFileName := module.Name + ".conf"
+	moduleFilePath := filepath.Join(imageChroot.RootDir(), "/etc/modprobe.d/", moduleFileName)
+	err = mergeConfigLines(moduleFilePath, []string{fmt.Sprintf("blacklist %s", module.Name)})
+	if err != nil {
+		return fmt.Errorf("failed to write module disable configuration: %w", err)
+	}
+
+	return nil
+}
+
+// moduleOptionsLines renders the modprobe.d lines (options, softdep, install, remove) for module.
+func moduleOptionsLines(module imagecustomizerapi.Module) []string {
+	var lines []string
+
+	if module.Options != nil {
+		var options []string
+		for key, value := range module.Options {
+			options = append(options, fmt.Sprintf("%s=%s", key, value))
+		}
+		lines = append(lines, fmt.Sprintf("options %s %s", module.Name, strings.Join(options, " ")))
+	}
+
+	if len(module.Softdep.Pre) > 0 || len(module.Softdep.Post) > 0 {
+		var parts []string
+		if len(module.Softdep.Pre) > 0 {
+			parts = append(parts, "pre: "+strings.Join(module.Softdep.Pre, " "))
+		}
+		if len(module.Softdep.Post) > 0 {
+			parts = append(parts, "post: "+strings.Join(module.Softdep.Post, " "))
+		}
+		lines = append(lines, fmt.Sprintf("softdep %s %s", module.Name, strings.Join(parts, " ")))
+	}
+
+	if module.Install != "" {
+		lines = append(lines, fmt.Sprintf("install %s %s", module.Name, module.Install))
+	}
+
+	if module.Remove != "" {
+		lines = append(lines, fmt.Sprintf("remove %s %s", module.Name, module.Remove))
+	}
+
+	return lines
+}
+
+// mergeConfigLines appends any of newLines not already present in the file at path, preserving
+// its existing contents instead of clobbering them.
+func mergeConfigLines(path string, newLines []string) error {
+	var existingLines []string
+	if contents, err := os.ReadFile(path); err == nil {
+		existingLines = strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read (%s): %w", path, err)
+	}
+
+	present := make(map[string]bool, len(existingLines))
+	for _, line := range existingLines {
+		present[line] = true
+	}
+
+	lines := existingLines
+	changed := false
+	for _, line := range newLines {
+		if !present[line] {
+			lines = append(lines, line)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	// Drop a leading empty line, which splitting an existing but empty file produces. A blank
+	// first line of a non-empty existing file is dropped as well.
+	if len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+
+	return file.Write(strings.Join(lines, "\n")+"\n", path)
+}
+
+// validateModuleExists confirms that a kernel module with moduleName is present under
+// /lib/modules/<kver>/ for at least one installed kernel, so that typos fail the build instead of
+// silently doing nothing at boot.
+func validateModuleExists(moduleName string, imageChroot *safechroot.Chroot) error {
+	modulesRoot := filepath.Join(imageChroot.RootDir(), "/lib/modules")
+
+	kernelVersions, err := os.ReadDir(modulesRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read (%s): %w", modulesRoot, err)
+	}
+
+	// Kernel module filenames on disk always use underscores, but module names as written in
+	// configs (and accepted by modprobe/kmod) commonly use dashes interchangeably (e.g. "i2c-dev"
+	// vs "i2c_dev.ko"). Normalize both sides so that doesn't look like a typo.
+	normalizedModuleName := normalizeModuleName(moduleName)
+
+	for _, kernelVersion := range kernelVersions {
+		if !kernelVersion.IsDir() {
+			continue
+		}
+
+		kernelModulesDir := filepath.Join(modulesRoot, kernelVersion.Name())
+		found := false
+		err = filepath.WalkDir(kernelModulesDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && strings.HasPrefix(normalizeModuleName(entry.Name()), normalizedModuleName+".ko") {
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to walk (%s): %w", kernelModulesDir, err)
+		}
+
+		if found {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("kernel module (%s) not found under (%s)", moduleName, modulesRoot)
+}
+
+// normalizeModuleName replaces dashes with underscores, since the kernel treats them
+// interchangeably in module names but on-disk filenames always use underscores.
+func normalizeModuleName(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}